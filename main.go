@@ -6,13 +6,23 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -22,21 +32,106 @@ import (
 
 	"google.golang.org/appengine"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"cloud.google.com/go/compute/metadata"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	secretmanagerpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 )
 
 var jobs []*job
 
+// Mirror modes for job.Mode.
+const (
+	modeBranch = "branch" // track a single branch (legacy behavior)
+	modeMirror = "mirror" // full mirror of all refs
+)
+
+var (
+	metricLastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reposync_last_sync_timestamp_seconds",
+		Help: "Unix timestamp of the last successful sync for a job.",
+	}, []string{"id"})
+
+	metricSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "reposync_sync_duration_seconds",
+		Help: "Duration of a sync phase (clone, remote, pull, update, push, push_tags).",
+	}, []string{"id", "phase"})
+
+	metricSyncFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reposync_sync_failures_total",
+		Help: "Count of failed sync phases.",
+	}, []string{"id", "phase"})
+
+	// metricHeadSHA is an info metric: always 1, with the short SHA of the
+	// last synced commit as a label, so it shows up in a join/query without
+	// needing a separate series per SHA value.
+	metricHeadSHA = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reposync_head_sha",
+		Help: "Always 1; labeled with the short SHA last synced for a job.",
+	}, []string{"id", "sha"})
+
+	metricPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reposync_pending",
+		Help: "1 while a job's sync is in flight, 0 otherwise.",
+	}, []string{"id"})
+)
+
+func init() {
+	prometheus.MustRegister(metricLastSync, metricSyncDuration, metricSyncFailures, metricHeadSHA, metricPending)
+}
+
+// credentials describes where to fetch git auth for a job from, instead of
+// embedding a token in From/To. Name is the secret's resource name
+// (secretmanager) or project metadata attribute (metadata); Username is
+// paired with the resolved token in the job's credential store. Provider
+// "gitauth" is a no-op, deferring to whatever credential helper chain is
+// already configured on the host.
+type credentials struct {
+	Provider string // "secretmanager", "metadata", or "gitauth"
+	Name     string
+	Username string
+}
+
 type job struct {
-	ID   string
-	From string
-	To   string
+	ID          string
+	From        string
+	To          string
+	Mode        string      // "mirror" or "branch" (default)
+	Secret      string      // webhook HMAC secret; may be "metadata:<attr>"
+	Credentials credentials // how to obtain git auth, if not embedded in From/To
+	MaxAttempts int         // consecutive failures before a phase parks (0 = defaultMaxAttempts)
+
+	// trigger is signaled to kick off an immediate sync, bypassing the
+	// rate limiter's normal polling interval.
+	trigger chan struct{}
+
+	// retry is signaled by /retry/{id} to wake a parked job.
+	retry chan struct{}
+
+	// repoMu guards git operations against j.dir(), so an archive request
+	// can't read the repo mid-pull/push.
+	repoMu sync.Mutex
 
 	// Status reporting
 	mu            sync.Mutex
 	statusTime    time.Time // time status was set
 	statusOK      bool      // normal state?
 	statusMessage string    // status indicator, suitable for public use
+	parked        bool      // true while a phase has exhausted its retry budget
+
+	// phaseAttempts/phaseCategory track, per phase ("clone", "remote",
+	// "pull", "update", "push", "push-tags"), the current consecutive
+	// failure count and a coarse category for the last error, so /status
+	// can tell a transient network blip from an auth failure from a
+	// rejected push.
+	phaseAttempts map[string]int
+	phaseCategory map[string]string
+
+	// lastMetricSHA is the short SHA currently set as the reposync_head_sha
+	// label value, so it can be cleared when it changes.
+	lastMetricSHA string
 }
 
 func main() {
@@ -68,16 +163,44 @@ func main() {
 		}
 		j.From = reconcile(j.From)
 		j.To = reconcile(j.To)
+		j.Secret = reconcile(j.Secret)
+		if j.Mode == "" {
+			j.Mode = modeBranch
+		}
 		j.statusOK = true
+		j.trigger = make(chan struct{}, 1)
+		j.retry = make(chan struct{}, 1)
+
+		if j.Credentials.Provider != "" {
+			if err := j.refreshCredentials(); err != nil {
+				log.Fatalf("Could not resolve credentials for job %q: %v", j.ID, err)
+			}
+			go j.refreshCredentialsLoop()
+		}
 
 		go j.mirror()
 	}
 
 	http.HandleFunc("/status", statusz)
+	http.HandleFunc("/hook/", hookHandler)
+	http.HandleFunc("/retry/", retryHandler)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/tar/", archiveHandler("tar"))
+	http.HandleFunc("/zip/", archiveHandler("zip"))
 
 	appengine.Main()
 }
 
+// findJob returns the job with the given ID, or nil if none matches.
+func findJob(id string) *job {
+	for _, j := range jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
 // reconcile gets a value from the GCE metadata server if the given string is
 // prefixed with "metadata:".
 func reconcile(s string) string {
@@ -95,84 +218,689 @@ func (j *job) dir() string {
 	return "repo-" + j.ID
 }
 
-func (j *job) mirror() {
-	j.ok("Cloning")
+// defaultMaxAttempts is how many consecutive failures a phase tolerates
+// before parking, for jobs that don't set MaxAttempts.
+const defaultMaxAttempts = 10
+
+const (
+	backoffBase = 2 * time.Second
+	backoffCap  = 5 * time.Minute
+)
+
+// backoffDelay returns a jittered exponential backoff delay for the given
+// zero-based attempt number: min(cap, base*2^attempt) plus up to 20% jitter,
+// so a string of failures doesn't hammer the upstream in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	d := backoffCap
+	if attempt < 32 { // avoid overflowing the shift for pathological attempt counts
+		if scaled := backoffBase * time.Duration(int64(1)<<uint(attempt)); scaled > 0 && scaled < backoffCap {
+			d = scaled
+		}
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/5 + 1))
+	return d + jitter
+}
+
+func (j *job) maxAttempts() int {
+	if j.MaxAttempts > 0 {
+		return j.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// categorizeError classifies git's output into a coarse failure category,
+// so repeated failures of different kinds don't all look identical in
+// /status.
+func categorizeError(out []byte) string {
+	s := strings.ToLower(string(out))
+	switch {
+	case strings.Contains(s, "non-fast-forward") || strings.Contains(s, "[rejected]"):
+		return "ref rejected (non-fast-forward)"
+	case strings.Contains(s, "authentication failed"),
+		strings.Contains(s, "permission denied"),
+		strings.Contains(s, "403"),
+		strings.Contains(s, "could not read username"):
+		return "auth failure"
+	default:
+		return "transient network"
+	}
+}
+
+// notePhaseOK clears the failure count and category for ph, e.g. after it
+// succeeds.
+func (j *job) notePhaseOK(ph string) {
+	j.mu.Lock()
+	if j.phaseAttempts != nil {
+		j.phaseAttempts[ph] = 0
+		j.phaseCategory[ph] = ""
+	}
+	j.mu.Unlock()
+}
+
+// notePhaseError records a failure of ph, categorized from out.
+func (j *job) notePhaseError(ph string, out []byte) {
+	j.mu.Lock()
+	if j.phaseAttempts == nil {
+		j.phaseAttempts = map[string]int{}
+		j.phaseCategory = map[string]string{}
+	}
+	j.phaseAttempts[ph]++
+	j.phaseCategory[ph] = categorizeError(out)
+	j.mu.Unlock()
+}
+
+// runTimed runs cmd, recording its duration and, on failure, incrementing
+// the failure counter for phase.
+func (j *job) runTimed(phase string, cmd *exec.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	metricSyncDuration.WithLabelValues(j.ID, phase).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricSyncFailures.WithLabelValues(j.ID, phase).Inc()
+	}
+	return out, err
+}
+
+// setHeadMetric updates reposync_head_sha to the short form of sha,
+// clearing the job's previous label value so stale series don't linger.
+func (j *job) setHeadMetric(sha string) {
+	short := sha
+	if len(short) > 7 {
+		short = short[:7]
+	}
+
+	j.mu.Lock()
+	prev := j.lastMetricSHA
+	j.lastMetricSHA = short
+	j.mu.Unlock()
+
+	if prev != "" && prev != short {
+		metricHeadSHA.DeleteLabelValues(j.ID, prev)
+	}
+	metricHeadSHA.WithLabelValues(j.ID, short).Set(1)
+}
+
+// noteSynced marks the job as having completed a successful sync cycle
+// right now, regardless of whether there was anything new to push - a
+// quiet repo that's still being polled successfully shouldn't look stale.
+func (j *job) noteSynced() {
+	metricLastSync.WithLabelValues(j.ID).Set(float64(time.Now().Unix()))
+}
+
+func (j *job) phaseAttemptCount(ph string) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.phaseAttempts[ph]
+}
 
+func (j *job) setParked(parked bool) {
+	j.mu.Lock()
+	j.parked = parked
+	j.mu.Unlock()
+}
+
+// retryUntilSuccess calls fn, retrying with exponential backoff until it
+// succeeds. If ph exhausts its retry budget (job.maxAttempts), the job
+// parks - marked unhealthy and idle - until a /retry/{id} poke or a webhook
+// trigger wakes it, then resumes with a fresh budget.
+func (j *job) retryUntilSuccess(ph, label string, fn func() ([]byte, error)) []byte {
 	for {
-		cmd := exec.Command("git", "clone", j.From, j.dir())
-		out, err := cmd.CombinedOutput()
+		out, err := fn()
 		if err == nil {
-			j.ok("Cloned", out)
-			break
+			j.notePhaseOK(ph)
+			return out
 		}
-		j.statusErr("Cloning", err, out)
-		os.RemoveAll(j.dir())
-		time.Sleep(10 * time.Second)
-		continue
+
+		j.statusErr(label, err, out)
+		j.notePhaseError(ph, out)
+		n := j.phaseAttemptCount(ph)
+
+		if n >= j.maxAttempts() {
+			cat := categorizeError(out)
+			j.setParked(true)
+			j.statusErr(fmt.Sprintf("Parked: %s failed %d times in a row (%s); waiting for /retry/%s or a webhook", label, n, cat, j.ID))
+			select {
+			case <-j.trigger:
+			case <-j.retry:
+			}
+			j.setParked(false)
+			j.notePhaseOK(ph)
+			continue
+		}
+
+		time.Sleep(backoffDelay(n - 1))
+	}
+}
+
+// retryHandler handles POSTs to /retry/{id}, waking a parked job so it
+// retries its current phase immediately instead of waiting to be kicked by
+// a webhook. It is authenticated the same way as /hook/{id}, using the
+// job's configured Secret, so that a guessable job ID alone isn't enough
+// to force a parked job to retry.
+func retryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/retry/")
+	j := findJob(id)
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if j.Secret == "" {
+		http.Error(w, "webhook not configured for this repo", http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !validSignature(j.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	select {
+	case j.retry <- struct{}{}:
+	default:
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// credentialRefreshInterval is how often a job with Credentials configured
+// re-resolves its secret, so a rotated token is picked up without a redeploy.
+const credentialRefreshInterval = 30 * time.Minute
+
+func (j *job) credDir() string {
+	return "creds-" + j.ID
+}
+
+func (j *job) credFilePath() string {
+	return filepath.Join(j.credDir(), "git-credentials")
+}
+
+// credConfigPath returns an absolute path: GIT_CONFIG_GLOBAL is read
+// relative to the git subprocess's cwd, which for every command after the
+// clone is j.dir() (a different relative directory), not the process's own
+// cwd.
+func (j *job) credConfigPath() string {
+	rel := filepath.Join(j.credDir(), "gitconfig")
+	abs, err := filepath.Abs(rel)
+	if err != nil {
+		return rel
+	}
+	return abs
+}
+
+// credEnv returns the subprocess environment a git command should run with,
+// so it picks up this job's credential store instead of any other job's or
+// the host's own ~/.gitconfig. Returns nil (inherit the normal environment)
+// for jobs that embed auth in From/To directly.
+func (j *job) credEnv() []string {
+	if j.Credentials.Provider == "" || j.Credentials.Provider == "gitauth" {
+		return nil
 	}
+	return append(os.Environ(), "GIT_CONFIG_GLOBAL="+j.credConfigPath())
+}
 
+// refreshCredentials resolves the job's secret and materializes a
+// job-private credential store and gitconfig, so the resolved token never
+// appears in From/To, `git remote -v`, or process listings.
+func (j *job) refreshCredentials() error {
+	token, err := resolveSecret(j.Credentials)
+	if err != nil {
+		return err
+	}
+	if j.Credentials.Provider == "gitauth" {
+		return nil
+	}
+
+	if err := os.MkdirAll(j.credDir(), 0700); err != nil {
+		return err
+	}
+
+	lines := credentialLines(j.Credentials.Username, token, j.From, j.To)
+	data := strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(j.credFilePath(), []byte(data), 0600); err != nil {
+		return err
+	}
+
+	credFile, err := filepath.Abs(j.credFilePath())
+	if err != nil {
+		return err
+	}
+	config := fmt.Sprintf("[credential]\n\thelper = store --file=%s\n", credFile)
+	if err := ioutil.WriteFile(j.credConfigPath(), []byte(config), 0600); err != nil {
+		return err
+	}
+
+	j.ok("Refreshed credentials")
+	return nil
+}
+
+func (j *job) refreshCredentialsLoop() {
 	for {
-		j.ok("Setting remote")
-		cmd := exec.Command("git", "remote", "add", "to", j.To)
-		cmd.Dir = j.dir()
-		out, err := cmd.CombinedOutput()
-		if err == nil {
-			j.ok("Added remote", out)
-			break
+		time.Sleep(credentialRefreshInterval)
+		if err := j.refreshCredentials(); err != nil {
+			j.statusErr("refresh credentials", err)
 		}
-		j.statusErr("Adding remote", err, out)
-		time.Sleep(time.Second)
 	}
+}
+
+// resolveSecret fetches the git auth token for cr from its provider.
+func resolveSecret(cr credentials) (string, error) {
+	switch cr.Provider {
+	case "metadata":
+		return metadata.ProjectAttributeValue(cr.Name)
+	case "secretmanager":
+		return secretManagerLatest(cr.Name)
+	case "gitauth":
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown credentials provider %q", cr.Provider)
+	}
+}
+
+// secretManagerLatest returns the payload of the latest version of the
+// Secret Manager secret at the given resource name
+// (projects/*/secrets/*).
+func secretManagerLatest(name string) (string, error) {
+	ctx := context.Background()
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: name + "/versions/latest",
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(resp.Payload.Data), nil
+}
+
+// credentialLines builds the `.git-credentials` lines needed to
+// authenticate as username against each of the given http(s) remote URLs,
+// deduplicated by scheme+host since that's the granularity git's "store"
+// credential helper matches on.
+func credentialLines(username, token string, urls ...string) []string {
+	seen := map[string]bool{}
+	var lines []string
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || !strings.HasPrefix(u.Scheme, "http") {
+			continue
+		}
+		u.User = url.UserPassword(username, token)
+		u.Path = ""
+		line := u.String()
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (j *job) mirror() {
+	j.ok("Cloning")
+
+	out := j.retryUntilSuccess("clone", "Cloning", func() ([]byte, error) {
+		var cmd *exec.Cmd
+		if j.Mode == modeMirror {
+			cmd = exec.Command("git", "clone", "--mirror", j.From, j.dir())
+		} else {
+			cmd = exec.Command("git", "clone", j.From, j.dir())
+		}
+		cmd.Env = j.credEnv()
+		out, err := j.runTimed("clone", cmd)
+		if err != nil {
+			os.RemoveAll(j.dir())
+		}
+		return out, err
+	})
+	j.ok("Cloned", out)
+
+	j.ok("Setting remote")
+	out = j.retryUntilSuccess("remote", "Adding remote", func() ([]byte, error) {
+		cmd := exec.Command("git", "remote", "add", "to", j.To)
+		cmd.Dir = j.dir()
+		cmd.Env = j.credEnv()
+		return j.runTimed("remote", cmd)
+	})
+	j.ok("Added remote", out)
 
 	limit := rate.NewLimiter(rate.Every(2*time.Minute), 1)
 
-	var oldSHA string
+	var oldDigest string
 
 	for {
 		ctx := context.Background()
-		limit.Wait(ctx)
+		select {
+		case <-waitChan(ctx, limit):
+		case <-j.trigger:
+			log.Printf("Triggered by webhook")
+		}
 
+		oldDigest = j.syncOnce(ctx, oldDigest)
+	}
+}
+
+// syncOnce runs one pull/update-then-push cycle and returns the ref digest
+// to compare against on the next cycle. It holds repoMu for the duration,
+// so archive requests never read a repo that's mid-pull/push.
+func (j *job) syncOnce(ctx context.Context, oldDigest string) string {
+	j.repoMu.Lock()
+	defer j.repoMu.Unlock()
+
+	metricPending.WithLabelValues(j.ID).Set(1)
+	defer metricPending.WithLabelValues(j.ID).Set(0)
+
+	if j.Mode == modeMirror {
+		log.Printf("Updating")
+		cmd := exec.Command("git", "remote", "update") // TODO: CommandContext once Flex is on 1.7
+		cmd.Dir = j.dir()
+		cmd.Env = j.credEnv()
+		out, err := j.runTimed("update", cmd)
+		if err != nil {
+			j.statusErr("Update", err, out)
+			j.notePhaseError("update", out)
+			return oldDigest
+		}
+		j.notePhaseOK("update")
+		j.noteSynced()
+		log.Printf("Updated: %s", out)
+	} else {
 		log.Printf("Pulling")
 		cmd := exec.Command("git", "pull") // TODO: CommandContext once Flex is on 1.7
 		cmd.Dir = j.dir()
-		out, err := cmd.CombinedOutput()
+		cmd.Env = j.credEnv()
+		out, err := j.runTimed("pull", cmd)
 		if err != nil {
 			j.statusErr("Pull", err, out)
-			continue
+			j.notePhaseError("pull", out)
+			return oldDigest
 		}
+		j.notePhaseOK("pull")
+		j.noteSynced()
 		log.Printf("Pulled: %s", out)
+	}
 
-		sha, err := ioutil.ReadFile(j.dir() + "/.git/refs/heads/master")
-		if err != nil {
-			j.statusErr("parse HEAD", err)
-			continue
-		}
+	digest, err := j.refDigest()
+	if err != nil {
+		j.statusErr("hash refs", err)
+		return oldDigest
+	}
 
-		if string(sha) == oldSHA {
-			j.ok("Synced - nothing to push: " + oldSHA)
-			continue
-		}
+	if digest == oldDigest {
+		j.ok("Synced - nothing to push: " + digest)
+		return oldDigest
+	}
 
+	if j.Mode == modeMirror {
+		log.Printf("Pushing mirror")
+		cmd := exec.CommandContext(ctx, "git", "push", "--mirror", "to")
+		cmd.Dir = j.dir()
+		cmd.Env = j.credEnv()
+		out, err := j.runTimed("push", cmd)
+		if err != nil {
+			j.statusErr("Push", err, out)
+			j.notePhaseError("push", out)
+			return oldDigest
+		}
+		j.notePhaseOK("push")
+		j.ok("Synced - pushed", out)
+	} else {
 		log.Printf("Pushing")
-		cmd = exec.CommandContext(ctx, "git", "push", "--all", "to")
+		cmd := exec.CommandContext(ctx, "git", "push", "--all", "to")
 		cmd.Dir = j.dir()
-		out, err = cmd.CombinedOutput()
+		cmd.Env = j.credEnv()
+		out, err := j.runTimed("push", cmd)
 		if err != nil {
 			j.statusErr("Push", err, out)
-			continue
+			j.notePhaseError("push", out)
+			return oldDigest
 		}
+		j.notePhaseOK("push")
 
 		log.Printf("Pushing tags")
 		cmd = exec.CommandContext(ctx, "git", "push", "--tags", "to")
 		cmd.Dir = j.dir()
-		out, err = cmd.CombinedOutput()
+		cmd.Env = j.credEnv()
+		out, err = j.runTimed("push_tags", cmd)
 		if err != nil {
 			j.statusErr("Push tags", err, out)
-			continue
+			j.notePhaseError("push-tags", out)
+			return oldDigest
 		}
-
+		j.notePhaseOK("push-tags")
 		j.ok("Synced - pushed", out)
-		oldSHA = string(sha)
+	}
+
+	if sha, err := j.revParse("HEAD"); err == nil {
+		j.setHeadMetric(sha)
+	}
+
+	return digest
+}
+
+// waitChan returns a channel that is closed once limit allows an event,
+// so it can be used alongside a job's trigger channel in a select.
+func waitChan(ctx context.Context, limit *rate.Limiter) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		limit.Wait(ctx)
+		close(ch)
+	}()
+	return ch
+}
+
+// refDigest hashes the name and target of every ref in the job's local repo,
+// so changes can be detected without relying on a working tree or a single
+// HEAD branch (a bare mirror clone has neither).
+func (j *job) refDigest() (string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = j.dir()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(out)
+	return fmt.Sprintf("%x", sum), nil
+}
+
+// resolveRef resolves ref to a commit SHA in the job's local repo.
+func (j *job) resolveRef(ref string) (string, error) {
+	j.repoMu.Lock()
+	defer j.repoMu.Unlock()
+	return j.revParse(ref)
+}
+
+// revParse resolves ref to a commit SHA. Unlike resolveRef, it doesn't take
+// repoMu, for callers (like syncOnce) that already hold it.
+func (j *job) revParse(ref string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", ref+"^{commit}")
+	cmd.Dir = j.dir()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// errArchiveTooLarge is returned by archive() when the archive would exceed
+// maxArchiveBytes.
+var errArchiveTooLarge = errors.New("archive exceeds size limit")
+
+// archive runs `git archive` for sha in the given format ("tar" or "zip"),
+// gzipping the tar case since git archive has no tar.gz format of its own.
+// It streams git's stdout rather than buffering the whole archive first, so
+// a ref that would blow past maxArchiveBytes kills the subprocess instead of
+// being fully materialized in memory.
+func (j *job) archive(format, sha string) ([]byte, error) {
+	j.repoMu.Lock()
+	defer j.repoMu.Unlock()
+
+	cmd := exec.Command("git", "archive", "--format="+format, sha)
+	cmd.Dir = j.dir()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	var dst io.Writer = buf
+	var gz *gzip.Writer
+	if format == "tar" {
+		gz = gzip.NewWriter(buf)
+		dst = gz
+	}
+
+	// Read at most one byte over the limit, so an oversized archive is
+	// detected without ever buffering all of it.
+	n, copyErr := io.Copy(dst, io.LimitReader(stdout, maxArchiveBytes+1))
+	if copyErr == nil && n > maxArchiveBytes {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errArchiveTooLarge
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// maxArchiveBytes caps the size of an archive served by archiveHandler.
+const maxArchiveBytes = 200 << 20 // 200MB
+
+// archives is an in-memory LRU of built archives, keyed by job ID, format,
+// and resolved commit SHA, so repeat requests for the same ref are cheap.
+var archives = newArchiveCache(64)
+
+type archiveCache struct {
+	mu    sync.Mutex
+	cap   int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type archiveCacheEntry struct {
+	key  string
+	data []byte
+}
+
+func newArchiveCache(n int) *archiveCache {
+	return &archiveCache{cap: n, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *archiveCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*archiveCacheEntry).data, true
+}
+
+func (c *archiveCache) add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*archiveCacheEntry).data = data
+		return
+	}
+
+	el := c.ll.PushFront(&archiveCacheEntry{key: key, data: data})
+	c.items[key] = el
+	if c.ll.Len() > c.cap {
+		oldest := c.ll.Remove(c.ll.Back()).(*archiveCacheEntry)
+		delete(c.items, oldest.key)
+	}
+}
+
+// archiveContentType returns the Content-Type for a given archive format.
+func archiveContentType(format string) string {
+	if format == "tar" {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+// archiveHandler returns a handler for /{format}/{id}/{ref} that streams a
+// git archive of the resolved ref, serving from the archives cache when
+// possible and supporting conditional requests via ETag.
+func archiveHandler(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/"+format+"/")
+		parts := strings.SplitN(path, "/", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		id, ref := parts[0], parts[1]
+
+		j := findJob(id)
+		if j == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		sha, err := j.resolveRef(ref)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		etag := `"` + sha + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		key := id + ":" + format + ":" + sha
+		data, ok := archives.get(key)
+		if !ok {
+			data, err = j.archive(format, sha)
+			if err == errArchiveTooLarge {
+				http.Error(w, "archive too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "could not build archive", http.StatusInternalServerError)
+				return
+			}
+			archives.add(key, data)
+		}
+
+		w.Header().Set("Content-Type", archiveContentType(format))
+		w.Write(data)
 	}
 }
 
@@ -199,10 +927,69 @@ func statusz(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "OK", j.statusOK)
 		fmt.Fprintln(w, j.statusTime)
 		fmt.Fprintln(w, j.statusMessage)
+		if j.parked {
+			fmt.Fprintln(w, "PARKED - waiting for /retry/"+j.ID+" or a webhook")
+		}
+		for ph, n := range j.phaseAttempts {
+			if n > 0 {
+				fmt.Fprintf(w, "  %s: %d failed attempts (%s)\n", ph, n, j.phaseCategory[ph])
+			}
+		}
 		j.mu.Unlock()
 	}
 }
 
+// hookHandler handles POSTs to /hook/{id} from GitHub, Gitea, and other
+// webhooks that sign their payload with X-Hub-Signature-256, and kicks the
+// matching job into an immediate sync instead of waiting for its next poll.
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/hook/")
+	j := findJob(id)
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if j.Secret == "" {
+		http.Error(w, "webhook not configured for this repo", http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	if !validSignature(j.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+		// A sync is already pending; nothing more to do.
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature reports whether sig (the X-Hub-Signature-256 header value)
+// is a valid HMAC-SHA256 of body using secret.
+func validSignature(secret string, body []byte, sig string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+	want, err := hex.DecodeString(sig[len(prefix):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
 func (j *job) ok(msg string, v ...interface{}) {
 	j.status(true, msg, v...)
 }